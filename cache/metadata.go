@@ -0,0 +1,118 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package cache
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/pkg/errors"
+)
+
+// BlobMetadata is the small amount of per-blob state MetadataCache persists:
+// enough for a resolver to skip re-resolving a blob's URL on a later run and
+// to revalidate it cheaply (via conditional requests) without re-fetching
+// any of its bytes.
+type BlobMetadata struct {
+	URL          string
+	Size         int64
+	ETag         string
+	LastModified string
+}
+
+// MetadataCache persists BlobMetadata across restarts, keyed by the
+// repository reference and content digest a blob was resolved under.
+type MetadataCache interface {
+	// Get returns the metadata previously recorded for (ref, digest), if any.
+	Get(ref, digest string) (BlobMetadata, bool)
+
+	// Add records (or overwrites) the metadata for (ref, digest).
+	Add(ref, digest string, meta BlobMetadata)
+}
+
+// NewFileMetadataCache returns a MetadataCache backed by a single JSON file
+// at path, loading any entries already there. A missing file is treated as
+// an empty cache rather than an error, since the first run on a fresh
+// daemon won't have one yet.
+func NewFileMetadataCache(path string) (*FileMetadataCache, error) {
+	c := &FileMetadataCache{path: path, entries: make(map[string]BlobMetadata)}
+	f, err := os.Open(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return c, nil
+		}
+		return nil, errors.Wrapf(err, "failed to open metadata cache %q", path)
+	}
+	defer f.Close()
+	if err := json.NewDecoder(f).Decode(&c.entries); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse metadata cache %q", path)
+	}
+	return c, nil
+}
+
+// FileMetadataCache is a MetadataCache backed by a single JSON file. Entries
+// are kept in memory and the whole file is rewritten on every Add; this
+// cache holds one small entry per resolved layer, so the cost of a full
+// rewrite is negligible and it keeps the on-disk format trivial to inspect.
+type FileMetadataCache struct {
+	mu      sync.Mutex
+	path    string
+	entries map[string]BlobMetadata
+}
+
+func (c *FileMetadataCache) Get(ref, digest string) (BlobMetadata, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	m, ok := c.entries[metadataKey(ref, digest)]
+	return m, ok
+}
+
+func (c *FileMetadataCache) Add(ref, digest string, meta BlobMetadata) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[metadataKey(ref, digest)] = meta
+	// Best-effort: a failed write only costs an extra resolve after the
+	// next restart, not correctness, so we don't propagate this error to
+	// callers of Add (which, per the MetadataCache interface, can't report
+	// one anyway).
+	c.save()
+}
+
+func (c *FileMetadataCache) save() error {
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(f).Encode(c.entries); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, c.path)
+}
+
+func metadataKey(ref, digest string) string {
+	return ref + "@" + digest
+}
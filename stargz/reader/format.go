@@ -0,0 +1,245 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"fmt"
+	"io"
+
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/containerd/stargz-snapshotter/zstdchunked"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// Format identifies which on-disk layer format a Reader is backed by, so
+// callers (metrics/telemetry in particular) can tell eStargz and
+// zstd:chunked layers apart.
+type Format int
+
+const (
+	FormatEStargz Format = iota
+	FormatZstdChunked
+)
+
+func (f Format) String() string {
+	switch f {
+	case FormatEStargz:
+		return "estargz"
+	case FormatZstdChunked:
+		return "zstd:chunked"
+	default:
+		return "unknown"
+	}
+}
+
+var (
+	gzipMagic = [2]byte{0x1f, 0x8b}
+	zstdMagic = [4]byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detectFormat sniffs the first bytes of sr to tell an eStargz layer
+// (a gzip stream) apart from a zstd:chunked one (a zstd frame).
+func detectFormat(sr *io.SectionReader) (Format, error) {
+	magic := make([]byte, 4)
+	if _, err := sr.ReadAt(magic, 0); err != nil && err != io.EOF {
+		return 0, errors.Wrap(err, "failed to sniff layer format")
+	}
+	if magic[0] == gzipMagic[0] && magic[1] == gzipMagic[1] {
+		return FormatEStargz, nil
+	}
+	if magic[0] == zstdMagic[0] && magic[1] == zstdMagic[1] && magic[2] == zstdMagic[2] && magic[3] == zstdMagic[3] {
+		return FormatZstdChunked, nil
+	}
+	return 0, fmt.Errorf("unrecognized layer format (not gzip or zstd)")
+}
+
+// entry is the information reader.go needs about a single file (or one
+// chunk of one), abstracted over the backing TOC/manifest format so the
+// rest of the package doesn't need to distinguish eStargz from
+// zstd:chunked.
+type entry struct {
+	Name        string
+	Type        string
+	Offset      int64
+	Size        int64
+	Digest      string
+	ChunkOffset int64
+	ChunkSize   int64
+	ChunkDigest string
+}
+
+// tocIndex is implemented by each supported layer format's TOC/manifest
+// parser and gives reader.go a uniform view over it.
+type tocIndex interface {
+	Lookup(name string) (*entry, bool)
+	OpenFile(name string) (io.ReaderAt, error)
+	ChunkEntryForOffset(name string, offset int64) (*entry, bool)
+
+	// ForeachChild calls f for every direct child of the directory entry
+	// named name ("" for root), stopping early if f returns false.
+	ForeachChild(name string, f func(baseName string, e *entry) bool)
+}
+
+// openIndex detects sr's format and parses it, verifying its TOC/manifest
+// digest against tocDigest: the same trust anchor is required for both
+// formats, so neither gives less end-to-end integrity than the other
+// against an untrusted registry or mirror.
+func openIndex(sr *io.SectionReader, tocDigest digest.Digest) (tocIndex, Format, error) {
+	format, err := detectFormat(sr)
+	if err != nil {
+		return nil, 0, err
+	}
+	switch format {
+	case FormatEStargz:
+		r, err := estargz.Open(sr)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to parse stargz")
+		}
+		if gotTOCDigest := r.TOCDigest(); gotTOCDigest != tocDigest {
+			return nil, 0, fmt.Errorf("invalid TOC digest %q; want %q", gotTOCDigest, tocDigest)
+		}
+		return estargzIndex{r}, FormatEStargz, nil
+	case FormatZstdChunked:
+		r, err := zstdchunked.Open(sr)
+		if err != nil {
+			return nil, 0, errors.Wrap(err, "failed to parse zstd:chunked layer")
+		}
+		if gotDigest := r.ManifestDigest(); gotDigest != tocDigest {
+			return nil, 0, fmt.Errorf("invalid zstd:chunked manifest digest %q; want %q", gotDigest, tocDigest)
+		}
+		return zstdchunkedIndex{r}, FormatZstdChunked, nil
+	default:
+		return nil, 0, fmt.Errorf("unsupported layer format")
+	}
+}
+
+type estargzIndex struct {
+	r *estargz.Reader
+}
+
+func (x estargzIndex) Lookup(name string) (*entry, bool) {
+	e, ok := x.r.Lookup(name)
+	if !ok {
+		return nil, false
+	}
+	return toEstargzEntry(e), true
+}
+
+func (x estargzIndex) OpenFile(name string) (io.ReaderAt, error) {
+	return x.r.OpenFile(name)
+}
+
+func (x estargzIndex) ChunkEntryForOffset(name string, offset int64) (*entry, bool) {
+	ce, ok := x.r.ChunkEntryForOffset(name, offset)
+	if !ok {
+		return nil, false
+	}
+	return toEstargzEntry(ce), true
+}
+
+func (x estargzIndex) ForeachChild(name string, f func(string, *entry) bool) {
+	e, ok := x.r.Lookup(name)
+	if !ok {
+		return
+	}
+	e.ForeachChild(func(baseName string, child *estargz.TOCEntry) bool {
+		return f(baseName, toEstargzEntry(child))
+	})
+}
+
+func toEstargzEntry(e *estargz.TOCEntry) *entry {
+	return &entry{
+		Name:        e.Name,
+		Type:        e.Type,
+		Offset:      e.Offset,
+		Size:        e.Size,
+		Digest:      e.Digest,
+		ChunkOffset: e.ChunkOffset,
+		ChunkSize:   e.ChunkSize,
+		ChunkDigest: e.ChunkDigest,
+	}
+}
+
+// zstdchunkedIndex adapts zstdchunked.Reader, whose manifest is a flat list
+// of files (no directory tree), onto tocIndex. ForeachChild("", f) walks
+// every file in the manifest; there is no notion of children below that,
+// which is sufficient for the prefetch policies in this package.
+type zstdchunkedIndex struct {
+	r *zstdchunked.Reader
+}
+
+func (x zstdchunkedIndex) Lookup(name string) (*entry, bool) {
+	if name == "" {
+		return &entry{Name: "", Type: "dir"}, true
+	}
+	e, ok := x.r.Lookup(name)
+	if !ok {
+		return nil, false
+	}
+	fe := toZstdEntry(e)
+	// e is only the file's first chunk; report the size of the whole file.
+	for end := e.ChunkOffset + e.UncompressedSize; ; {
+		ce, ok := x.r.ChunkEntryForOffset(name, end)
+		if !ok {
+			fe.Size = end
+			break
+		}
+		end = ce.ChunkOffset + ce.UncompressedSize
+	}
+	return fe, true
+}
+
+func (x zstdchunkedIndex) OpenFile(name string) (io.ReaderAt, error) {
+	return x.r.OpenFile(name)
+}
+
+func (x zstdchunkedIndex) ChunkEntryForOffset(name string, offset int64) (*entry, bool) {
+	ce, ok := x.r.ChunkEntryForOffset(name, offset)
+	if !ok {
+		return nil, false
+	}
+	return toZstdEntry(ce), true
+}
+
+func (x zstdchunkedIndex) ForeachChild(name string, f func(string, *entry) bool) {
+	if name != "" {
+		return
+	}
+	for _, path := range x.r.Paths() {
+		e, ok := x.r.Lookup(path)
+		if !ok {
+			continue
+		}
+		if !f(path, toZstdEntry(e)) {
+			return
+		}
+	}
+}
+
+func toZstdEntry(e *zstdchunked.TOCEntry) *entry {
+	return &entry{
+		Name:        e.Path,
+		Type:        "reg",
+		Offset:      e.Offset,
+		Size:        e.UncompressedSize,
+		Digest:      e.Digest,
+		ChunkOffset: e.ChunkOffset,
+		ChunkSize:   e.UncompressedSize,
+		ChunkDigest: e.Digest,
+	}
+}
@@ -0,0 +1,183 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// TraceAccessTableTarName is the TOC entry name for an access trace embedded
+// in the layer itself. Nothing in this package reads a trace from that
+// entry: an AccessTracePolicy gets its trace only from
+// NewAccessTracePolicyFromJSON or its Trace field.
+const TraceAccessTableTarName = ".access.trace.json"
+
+// PrefetchChunk identifies a single chunk to prefetch by the path of the
+// file it belongs to and the chunk's byte range within that file, as
+// recorded in the TOC.
+type PrefetchChunk struct {
+	Path        string
+	ChunkOffset int64
+	ChunkSize   int64
+}
+
+// PrefetchPolicy determines which chunks a Reader should eagerly populate
+// into its cache before regular file access, and in what order. Chunks are
+// resolved against the already-parsed TOC of gr, so a policy never has to
+// touch the remote blob itself.
+type PrefetchPolicy interface {
+	Chunks(gr *Reader) ([]PrefetchChunk, error)
+}
+
+// LandmarkPolicy is the original prefetch heuristic: prefetch everything up
+// to the position of the PrefetchLandmark entry (or the whole layer, if no
+// landmark is present), unless NoPrefetchLandmark says to skip prefetch
+// entirely.
+type LandmarkPolicy struct{}
+
+func (LandmarkPolicy) Chunks(gr *Reader) ([]PrefetchChunk, error) {
+	if _, ok := gr.r.Lookup(NoPrefetchLandmark); ok {
+		return nil, nil
+	}
+	end := gr.sr.Size()
+	if e, ok := gr.r.Lookup(PrefetchLandmark); ok {
+		if e.Offset > end {
+			return nil, fmt.Errorf("invalid landmark offset %d is larger than layer size %d",
+				e.Offset, end)
+		}
+		end = e.Offset
+	}
+	return chunksMatching(gr, func(e *entry) bool {
+		return e.Offset < end
+	})
+}
+
+// AccessTraceEntry is a single recorded access in an access-trace file: the
+// file that was opened and which chunk of it was read, in the order it was
+// observed during a real container startup.
+type AccessTraceEntry struct {
+	Path        string `json:"path"`
+	ChunkOffset int64  `json:"chunkOffset"`
+	ChunkSize   int64  `json:"chunkSize"`
+}
+
+// AccessTracePolicy prefetches exactly the chunks recorded in an
+// access-trace file, in access order. This lets an image builder record a
+// real container startup trace once and ship it as a sidecar, dramatically
+// improving cold-start latency for images whose hot set doesn't sit at the
+// beginning of the tar.
+type AccessTracePolicy struct {
+	Trace []AccessTraceEntry
+}
+
+// NewAccessTracePolicyFromJSON parses r as a JSON array of AccessTraceEntry
+// in access order.
+func NewAccessTracePolicyFromJSON(r io.Reader) (*AccessTracePolicy, error) {
+	var trace []AccessTraceEntry
+	if err := json.NewDecoder(r).Decode(&trace); err != nil {
+		return nil, errors.Wrap(err, "failed to parse access trace")
+	}
+	return &AccessTracePolicy{Trace: trace}, nil
+}
+
+func (p *AccessTracePolicy) Chunks(gr *Reader) ([]PrefetchChunk, error) {
+	chunks := make([]PrefetchChunk, 0, len(p.Trace))
+	for _, t := range p.Trace {
+		if _, ok := gr.r.Lookup(t.Path); !ok {
+			// The file recorded in the trace no longer exists in this
+			// layer (e.g. the image was rebuilt); skip it rather than
+			// failing prefetch for the whole layer.
+			continue
+		}
+		chunks = append(chunks, PrefetchChunk{
+			Path:        t.Path,
+			ChunkOffset: t.ChunkOffset,
+			ChunkSize:   t.ChunkSize,
+		})
+	}
+	return chunks, nil
+}
+
+// PriorityGlobPolicy prefetches every chunk of every regular file whose
+// path matches one of Globs, in the order the globs are given.
+type PriorityGlobPolicy struct {
+	Globs []string
+}
+
+func (p *PriorityGlobPolicy) Chunks(gr *Reader) ([]PrefetchChunk, error) {
+	var chunks []PrefetchChunk
+	for _, pattern := range p.Globs {
+		matched, err := chunksMatching(gr, func(e *entry) bool {
+			ok, err := filepath.Match(pattern, e.Name)
+			return err == nil && ok
+		})
+		if err != nil {
+			return nil, err
+		}
+		chunks = append(chunks, matched...)
+	}
+	return chunks, nil
+}
+
+// chunksMatching walks every regular file entry in gr's TOC and returns the
+// chunks of those for which match returns true, in a stable file-name order.
+func chunksMatching(gr *Reader, match func(e *entry) bool) ([]PrefetchChunk, error) {
+	root, ok := gr.r.Lookup("")
+	if !ok {
+		return nil, fmt.Errorf("failed to get a TOCEntry of the root")
+	}
+	var names []string
+	var walk func(e *entry)
+	walk = func(e *entry) {
+		gr.r.ForeachChild(e.Name, func(_ string, child *entry) bool {
+			if child.Type == "reg" && match(child) {
+				names = append(names, child.Name)
+			}
+			walk(child)
+			return true
+		})
+	}
+	walk(root)
+	sort.Strings(names)
+
+	var chunks []PrefetchChunk
+	for _, name := range names {
+		fe, ok := gr.r.Lookup(name)
+		if !ok {
+			continue
+		}
+		for nr := int64(0); nr < fe.Size; {
+			ce, ok := gr.r.ChunkEntryForOffset(name, nr)
+			if !ok {
+				break
+			}
+			chunks = append(chunks, PrefetchChunk{
+				Path:        name,
+				ChunkOffset: ce.ChunkOffset,
+				ChunkSize:   ce.ChunkSize,
+			})
+			nr += ce.ChunkSize
+		}
+	}
+	return chunks, nil
+}
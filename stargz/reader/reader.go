@@ -24,17 +24,19 @@ package reader
 
 import (
 	"archive/tar"
-	"bytes"
 	"compress/gzip"
 	"crypto/sha256"
 	"fmt"
 	"io"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/containerd/stargz-snapshotter/cache"
-	"github.com/google/crfs/stargz"
+	"github.com/containerd/stargz-snapshotter/estargz"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -48,33 +50,55 @@ const (
 	NoPrefetchLandmark = ".no.prefetch.landmark"
 )
 
-func NewReader(sr *io.SectionReader, cache cache.BlobCache) (*Reader, *stargz.TOCEntry, error) {
-	r, err := stargz.Open(sr)
+// NewReader parses the stargz-formatted blob exposed through sr (either
+// eStargz or zstd:chunked, auto-detected) and returns a Reader for it.
+// tocDigest must be the TOC/manifest digest the caller trusts for this
+// layer (e.g. obtained from the layer's
+// `containerd.io/snapshot/stargz/toc.digest` manifest annotation); the
+// parsed TOC/manifest is verified against it before this function returns,
+// for either format, so a malicious or corrupted blob is rejected up front
+// rather than silently served. policy controls what PrefetchWithReader
+// eagerly caches; if nil, LandmarkPolicy{} is used.
+func NewReader(sr *io.SectionReader, cache cache.BlobCache, tocDigest digest.Digest, policy PrefetchPolicy) (*Reader, *entry, error) {
+	idx, format, err := openIndex(sr, tocDigest)
 	if err != nil {
-		return nil, nil, errors.Wrap(err, "failed to parse stargz")
+		return nil, nil, err
 	}
 
-	root, ok := r.Lookup("")
+	root, ok := idx.Lookup("")
 	if !ok {
 		return nil, nil, fmt.Errorf("failed to get a TOCEntry of the root")
 	}
 
+	if policy == nil {
+		policy = LandmarkPolicy{}
+	}
+
 	return &Reader{
-		r:                      r,
+		r:                      idx,
+		format:                 format,
 		sr:                     sr,
 		cache:                  cache,
+		policy:                 policy,
 		prefetchCompletionCond: sync.NewCond(&sync.Mutex{}),
 	}, root, nil
 }
 
 type Reader struct {
-	r                      *stargz.Reader
+	r                      tocIndex
+	format                 Format
 	sr                     *io.SectionReader
 	cache                  cache.BlobCache
+	policy                 PrefetchPolicy
 	prefetchInProgress     bool
 	prefetchCompletionCond *sync.Cond
 }
 
+// Format reports which on-disk layer format this Reader was parsed from.
+func (gr *Reader) Format() Format {
+	return gr.format
+}
+
 func (gr *Reader) OpenFile(name string) (io.ReaderAt, error) {
 	sr, err := gr.r.OpenFile(name)
 	if err != nil {
@@ -93,43 +117,90 @@ func (gr *Reader) OpenFile(name string) (io.ReaderAt, error) {
 	}, nil
 }
 
-func (gr *Reader) PrefetchWithReader(sr *io.SectionReader, prefetchSize int64) error {
+// PrefetchWithReader eagerly populates gr's cache with the chunks selected
+// by gr's PrefetchPolicy. Each file's chunks are fetched through the same
+// OpenFile/ReadAt path regular file access uses, so the underlying
+// remote.fetcher sees the same traffic it would from a real read and can
+// coalesce nearby requests the same way.
+func (gr *Reader) PrefetchWithReader() error {
 	gr.prefetchInProgress = true
 	defer func() {
 		gr.prefetchInProgress = false
 		gr.prefetchCompletionCond.Broadcast()
 	}()
 
-	if _, ok := gr.r.Lookup(NoPrefetchLandmark); ok {
-		// do not prefetch this layer
-		return nil
-	} else if e, ok := gr.r.Lookup(PrefetchLandmark); ok {
-		// override the prefetch size with optimized value
-		if e.Offset > sr.Size() {
-			return fmt.Errorf("invalid landmark offset %d is larger than layer size %d",
-				e.Offset, sr.Size())
-		}
-		prefetchSize = e.Offset
-	} else if prefetchSize > sr.Size() {
-		// adjust prefetch size not to exceed the whole layer size
-		prefetchSize = sr.Size()
+	chunks, err := gr.policy.Chunks(gr)
+	if err != nil {
+		return errors.Wrap(err, "failed to determine chunks to prefetch")
 	}
 
-	// Fetch specified range at once
-	// TODO: when prefetchSize is too large, save memory by chunking the range
-	prefetchBytes := make([]byte, prefetchSize)
-	if _, err := io.ReadFull(sr, prefetchBytes); err != nil && err != io.EOF {
-		return errors.Wrap(err, "failed to prefetch layer data")
+	byPath := make(map[string][]PrefetchChunk)
+	var order []string
+	for _, c := range chunks {
+		if _, ok := byPath[c.Path]; !ok {
+			order = append(order, c.Path)
+		}
+		byPath[c.Path] = append(byPath[c.Path], c)
 	}
 
-	// Cache specified range to filesystem cache
-	err := gr.CacheTarGzWithReader(bytes.NewReader(prefetchBytes))
-	if err != io.EOF && err != io.ErrUnexpectedEOF {
-		return errors.Wrap(err, "error occurred during caching")
+	for _, path := range order {
+		// Use gr.OpenFile, not gr.r.OpenFile: the former returns the *file
+		// wrapper, whose ReadAt verifies each freshly-fetched chunk against
+		// its ChunkDigest before caching it. Going through gr.r directly
+		// would cache unverified data under the same id file.ReadAt later
+		// trusts on a cache hit.
+		ra, err := gr.OpenFile(path)
+		if err != nil {
+			return errors.Wrapf(err, "failed to open %q for prefetch", path)
+		}
+		// Issue one ReadAt per contiguous span of selected chunks rather than
+		// one per chunk: coalesceChunks merges adjacent and overlapping
+		// chunks into the fewest spans that still cover every selected
+		// chunk. file.ReadAt still reads each uncached chunk of a span from
+		// the blob with its own underlying ReadAt, so the blob's reader
+		// receives one read per uncached chunk, not one per span.
+		for _, span := range coalesceChunks(byPath[path]) {
+			data := make([]byte, span.size)
+			if _, err := ra.ReadAt(data, span.offset); err != nil && err != io.EOF {
+				return errors.Wrapf(err, "failed to prefetch %q", path)
+			}
+		}
 	}
 	return nil
 }
 
+// chunkSpan is a contiguous byte range, within a file, covering one or more
+// PrefetchChunks.
+type chunkSpan struct {
+	offset int64
+	size   int64
+}
+
+// coalesceChunks merges adjacent/overlapping chunks into the smallest set of
+// contiguous spans that cover all of them, the same way remote.coalesce
+// merges byte ranges before a single-range fallback fetch.
+func coalesceChunks(chunks []PrefetchChunk) []chunkSpan {
+	if len(chunks) == 0 {
+		return nil
+	}
+	sorted := make([]PrefetchChunk, len(chunks))
+	copy(sorted, chunks)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].ChunkOffset < sorted[j].ChunkOffset })
+
+	spans := []chunkSpan{{offset: sorted[0].ChunkOffset, size: sorted[0].ChunkSize}}
+	for _, c := range sorted[1:] {
+		last := &spans[len(spans)-1]
+		if c.ChunkOffset <= last.offset+last.size {
+			if end := c.ChunkOffset + c.ChunkSize; end > last.offset+last.size {
+				last.size = end - last.offset
+			}
+			continue
+		}
+		spans = append(spans, chunkSpan{offset: c.ChunkOffset, size: c.ChunkSize})
+	}
+	return spans
+}
+
 func (gr *Reader) WaitForPrefetchCompletion(timeout time.Duration) error {
 	waitUntilPrefetching := func() <-chan struct{} {
 		ch := make(chan struct{})
@@ -153,12 +224,34 @@ func (gr *Reader) WaitForPrefetchCompletion(timeout time.Duration) error {
 	}
 }
 
+// CacheTarGzWithReader walks the tar archive compressed in r, caching every
+// chunk of every tar entry (other than the prefetch landmarks and the TOC
+// itself); a tar entry with no TOC entry is an error. r must be compressed the way
+// gr.Format() says this layer is (a single gzip stream for FormatEStargz, a
+// concatenation of independent zstd frames - the zstd decoder transparently
+// decodes that as one continuous stream - for FormatZstdChunked), so this
+// works uniformly for either format instead of assuming gzip.
 func (gr *Reader) CacheTarGzWithReader(r io.Reader) error {
-	gzr, err := gzip.NewReader(r)
-	if err != nil {
-		return err
+	var decompressed io.Reader
+	switch gr.format {
+	case FormatEStargz:
+		gzr, err := gzip.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer gzr.Close()
+		decompressed = gzr
+	case FormatZstdChunked:
+		zr, err := zstd.NewReader(r)
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		decompressed = zr
+	default:
+		return fmt.Errorf("CacheTarGzWithReader: unsupported layer format %v", gr.format)
 	}
-	tr := tar.NewReader(gzr)
+	tr := tar.NewReader(decompressed)
 	for {
 		h, err := tr.Next()
 		if err != nil {
@@ -169,7 +262,7 @@ func (gr *Reader) CacheTarGzWithReader(r io.Reader) error {
 		}
 		if h.Name == PrefetchLandmark ||
 			h.Name == NoPrefetchLandmark ||
-			h.Name == stargz.TOCTarName {
+			h.Name == estargz.TOCTarName {
 			// We don't need to cache prefetch landmarks and TOC json file.
 			continue
 		}
@@ -196,6 +289,9 @@ func (gr *Reader) CacheTarGzWithReader(r io.Reader) error {
 				if _, err := io.ReadFull(tr, data); err != nil && err != io.EOF {
 					return err
 				}
+				if err := verifyChunk(data, ce); err != nil {
+					return errors.Wrapf(err, "failed to verify chunk of %q", h.Name)
+				}
 				gr.cache.Add(id, data)
 			}
 			nr += ce.ChunkSize
@@ -208,12 +304,15 @@ type file struct {
 	name   string
 	digest string
 	ra     io.ReaderAt
-	r      *stargz.Reader
+	r      tocIndex
 	cache  cache.BlobCache
 }
 
 // ReadAt reads chunks from the stargz file with trying to fetch as many chunks
-// as possible from the cache.
+// as possible from the cache. Each chunk freshly fetched from the remote is
+// verified against its ChunkDigest recorded in the TOC before being served or
+// cached; a chunk already in the cache is trusted since it was verified when
+// it was added.
 func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	nr := 0
 	for nr < len(p) {
@@ -230,6 +329,9 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 					return 0, errors.Wrap(err, "failed to read data")
 				}
 			}
+			if err := verifyChunk(data, ce); err != nil {
+				return 0, errors.Wrapf(err, "failed to verify chunk of %q", sf.name)
+			}
 			sf.cache.Add(id, data)
 		}
 		n := copy(p[nr:], data[offset+int64(nr)-ce.ChunkOffset:])
@@ -240,6 +342,23 @@ func (sf *file) ReadAt(p []byte, offset int64) (int, error) {
 	return len(p), nil
 }
 
+// verifyChunk checks data against the digest recorded for ce in the TOC,
+// returning an error if they don't match so that corrupted or tampered
+// chunks never enter the cache or get served to the filesystem layer.
+func verifyChunk(data []byte, ce *entry) error {
+	if ce.ChunkDigest == "" {
+		return fmt.Errorf("no digest recorded for chunk at offset %d", ce.ChunkOffset)
+	}
+	wantDigest, err := digest.Parse(ce.ChunkDigest)
+	if err != nil {
+		return errors.Wrapf(err, "invalid chunk digest %q", ce.ChunkDigest)
+	}
+	if gotDigest := digest.FromBytes(data); gotDigest != wantDigest {
+		return fmt.Errorf("unexpected chunk digest %q; want %q", gotDigest, wantDigest)
+	}
+	return nil
+}
+
 func genID(digest string, offset, size int64) string {
 	sum := sha256.Sum256([]byte(fmt.Sprintf("%s-%d-%d", digest, offset, size)))
 	return fmt.Sprintf("%x", sum)
@@ -0,0 +1,162 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package reader
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"testing"
+
+	"github.com/containerd/stargz-snapshotter/zstdchunked"
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+)
+
+// fakeBlobCache is a minimal in-memory cache.BlobCache for tests.
+type fakeBlobCache struct {
+	data map[string][]byte
+}
+
+func newFakeBlobCache() *fakeBlobCache {
+	return &fakeBlobCache{data: make(map[string][]byte)}
+}
+
+func (c *fakeBlobCache) Fetch(id string) ([]byte, error) {
+	d, ok := c.data[id]
+	if !ok {
+		return nil, fmt.Errorf("not found: %s", id)
+	}
+	return d, nil
+}
+
+func (c *fakeBlobCache) Add(id string, data []byte) {
+	c.data[id] = append([]byte(nil), data...)
+}
+
+// buildZstdChunkedBlob builds a one-file zstd:chunked blob whose single
+// chunk holds content, tagging it with chunkDigest (deliberately wrong
+// values let tests exercise the digest-mismatch paths).
+func buildZstdChunkedBlob(t *testing.T, path string, content []byte, chunkDigest digest.Digest) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+
+	frame := enc.EncodeAll(content, nil)
+	var buf bytes.Buffer
+	buf.Write(frame)
+
+	entries := []*zstdchunked.TOCEntry{{
+		Path:             path,
+		Offset:           0,
+		Length:           int64(len(frame)),
+		ChunkOffset:      0,
+		UncompressedSize: int64(len(content)),
+		Digest:           chunkDigest.String(),
+	}}
+	manifestOffset := int64(buf.Len())
+	manifest, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	buf.Write(enc.EncodeAll(manifest, nil))
+
+	footer := make([]byte, 8)
+	binary.LittleEndian.PutUint64(footer, uint64(manifestOffset))
+	buf.Write(footer)
+	return buf.Bytes()
+}
+
+func manifestDigestOf(t *testing.T, blob []byte) digest.Digest {
+	t.Helper()
+	r, err := zstdchunked.Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err != nil {
+		t.Fatalf("failed to parse test blob: %v", err)
+	}
+	return r.ManifestDigest()
+}
+
+func TestNewReaderRejectsWrongTOCDigest(t *testing.T) {
+	content := []byte("hello world")
+	blob := buildZstdChunkedBlob(t, "hello.txt", content, digest.FromBytes(content))
+
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	_, _, err := NewReader(sr, newFakeBlobCache(), digest.FromString("not-the-real-digest"), nil)
+	if err == nil {
+		t.Fatal("expected NewReader to reject a manifest digest mismatch")
+	}
+}
+
+func TestFileReadAtRejectsChunkDigestMismatch(t *testing.T) {
+	content := []byte("hello world")
+	// Tag the chunk with a digest that doesn't match content, simulating a
+	// corrupted or tampered blob.
+	blob := buildZstdChunkedBlob(t, "hello.txt", content, digest.FromBytes([]byte("not the real content")))
+	tocDigest := manifestDigestOf(t, blob)
+
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	cache := newFakeBlobCache()
+	gr, _, err := NewReader(sr, cache, tocDigest, nil)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+
+	ra, err := gr.OpenFile("hello.txt")
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	got := make([]byte, len(content))
+	if _, err := ra.ReadAt(got, 0); err == nil {
+		t.Fatal("expected ReadAt to reject a chunk digest mismatch")
+	}
+	if len(cache.data) != 0 {
+		t.Errorf("a chunk that failed digest verification must not be cached; cache has %d entries", len(cache.data))
+	}
+}
+
+func TestFileReadAtAcceptsValidChunk(t *testing.T) {
+	content := []byte("hello world")
+	blob := buildZstdChunkedBlob(t, "hello.txt", content, digest.FromBytes(content))
+	tocDigest := manifestDigestOf(t, blob)
+
+	sr := io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob)))
+	cache := newFakeBlobCache()
+	gr, _, err := NewReader(sr, cache, tocDigest, nil)
+	if err != nil {
+		t.Fatalf("NewReader failed: %v", err)
+	}
+
+	ra, err := gr.OpenFile("hello.txt")
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	got := make([]byte, len(content))
+	if _, err := ra.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("ReadAt = %q; want %q", got, content)
+	}
+	if len(cache.data) != 1 {
+		t.Errorf("expected the verified chunk to be cached; cache has %d entries", len(cache.data))
+	}
+}
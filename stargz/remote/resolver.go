@@ -31,6 +31,7 @@ import (
 	"mime"
 	"mime/multipart"
 	"net/http"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
@@ -41,6 +42,7 @@ import (
 	"github.com/google/go-containerregistry/pkg/authn"
 	"github.com/google/go-containerregistry/pkg/name"
 	"github.com/google/go-containerregistry/pkg/v1/remote/transport"
+	digest "github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
 )
 
@@ -54,8 +56,36 @@ type ResolverConfig struct {
 }
 
 type MirrorConfig struct {
-	Host     string `toml:"host"`
-	Insecure bool   `toml:"insecure"`
+	// Host is the domain name (optionally with port) to resolve the blob
+	// against instead of the image's own registry.
+	Host string `toml:"host"`
+
+	// Insecure allows this mirror to be accessed over plain HTTP / with an
+	// unverified TLS certificate.
+	Insecure bool `toml:"insecure"`
+
+	// Header holds extra HTTP headers to send on every request to this
+	// mirror (e.g. `Authorization`, `X-Registry-*`). Useful for Harbor
+	// pull-through caches, in-cluster proxies and similar deployments that
+	// gate access on a header rather than standard registry auth.
+	Header map[string][]string `toml:"header"`
+
+	// Token, if set, is sent as a static `Authorization: Bearer <Token>`
+	// header and entirely replaces the normal keychain/token-exchange
+	// dance for this mirror.
+	Token string `toml:"token"`
+
+	// PathPrefix is prepended to the repository path for mirrors that
+	// serve the upstream repository under a fixed sub-path, e.g.
+	// `/v2/<PathPrefix>/<repository>/...`.
+	PathPrefix string `toml:"path_prefix"`
+
+	// Pull marks this mirror as pull-through only. The resolver currently
+	// only ever pulls blobs, so this doesn't change resolution behavior
+	// today; it's carried through onto the resolved Blob so future
+	// operations that can write (e.g. a refresh that pushes back) know not
+	// to treat this mirror as authoritative.
+	Pull bool `toml:"pull"`
 }
 
 type BlobConfig struct {
@@ -64,7 +94,11 @@ type BlobConfig struct {
 	ChunkSize     int64 `toml:"chunk_size"`
 }
 
-func NewResolver(keychain authn.Keychain, config map[string]ResolverConfig) *Resolver {
+// NewResolver creates a Resolver. metaCache, if non-nil, is consulted before
+// resolving a blob's URL/size over the network and updated afterwards, so
+// that a process restart doesn't have to re-resolve (redirect + HEAD) every
+// layer it already knows about.
+func NewResolver(keychain authn.Keychain, config map[string]ResolverConfig, metaCache cache.MetadataCache) *Resolver {
 	if config == nil {
 		config = make(map[string]ResolverConfig)
 	}
@@ -73,6 +107,7 @@ func NewResolver(keychain authn.Keychain, config map[string]ResolverConfig) *Res
 		trPool:    make(map[string]http.RoundTripper),
 		keychain:  keychain,
 		config:    config,
+		metaCache: metaCache,
 	}
 }
 
@@ -82,10 +117,19 @@ type Resolver struct {
 	trPoolMu  sync.Mutex
 	keychain  authn.Keychain
 	config    map[string]ResolverConfig
+	metaCache cache.MetadataCache
 }
 
-func (r *Resolver) Resolve(ref, digest string, cache cache.BlobCache, config BlobConfig) (Blob, error) {
-	fetcher, size, err := r.resolve(ref, digest)
+// Resolve resolves ref/digest into a Blob which can fetch chunks of the
+// layer from the registry (or a configured mirror). tocDigest is the
+// eStargz TOC digest the caller trusts for this layer (typically sourced
+// from the manifest's `containerd.io/snapshot/stargz/toc.digest`
+// annotation); it is plumbed through onto the returned Blob so that the
+// reader package can verify the TOC it ends up parsing actually matches
+// what the caller expects, giving end-to-end integrity even when the
+// registry or a mirror in the path is untrusted.
+func (r *Resolver) Resolve(ref, digest string, tocDigest digest.Digest, cache cache.BlobCache, config BlobConfig) (Blob, error) {
+	fetcher, size, err := r.resolve(ref, digest, false)
 	if err != nil {
 		return nil, err
 	}
@@ -113,6 +157,7 @@ func (r *Resolver) Resolve(ref, digest string, cache cache.BlobCache, config Blo
 		cache:         cache,
 		lastCheck:     time.Now(),
 		checkInterval: checkInterval,
+		tocDigest:     tocDigest,
 	}, nil
 }
 
@@ -139,12 +184,21 @@ func (r *Resolver) Refresh(target Blob) error {
 	return nil
 }
 
-func (r *Resolver) resolve(ref, digest string) (*fetcher, int64, error) {
+// resolve resolves ref/digest into a fetcher. skipMetaCache forces a real
+// resolveReference/getSize round trip (and a subsequent metaCache.Add that
+// overwrites whatever was cached) even if a prior run already cached this
+// blob's URL/size; Refresh uses this to recover from a metaCache entry that
+// has gone stale (e.g. a short-lived signed redirect URL that expired), since
+// otherwise a cached entry would be trusted forever and Refresh could never
+// observe a changed blob.
+func (r *Resolver) resolve(ref, digest string, skipMetaCache bool) (*fetcher, int64, error) {
 	var (
-		nref name.Reference
-		url  string
-		tr   http.RoundTripper
-		size int64
+		nref   name.Reference
+		url    string
+		tr     http.RoundTripper
+		size   int64
+		mirror MirrorConfig
+		meta   blobMeta
 	)
 	named, err := docker.ParseDockerRef(ref)
 	if err != nil {
@@ -164,7 +218,7 @@ func (r *Resolver) resolve(ref, digest string) (*fetcher, int64, error) {
 		if h.Insecure {
 			opts = append(opts, name.Insecure)
 		}
-		sref := fmt.Sprintf("%s/%s", h.Host, docker.Path(named))
+		sref := fmt.Sprintf("%s/%s", h.Host, mirrorRepoPath(docker.Path(named), h))
 		nref, err = name.ParseReference(sref, opts...)
 		if err != nil {
 			rErr = errors.Wrapf(rErr, "host %q: failed to parse ref %q (%q): %v",
@@ -172,8 +226,32 @@ func (r *Resolver) resolve(ref, digest string) (*fetcher, int64, error) {
 			continue // try another host
 		}
 
+		// If a prior run already resolved this blob's URL/size, reuse them
+		// and skip straight to building a transport; this saves both the
+		// redirect-resolution GET and the size HEAD on every cold start.
+		if r.metaCache != nil && !skipMetaCache {
+			if cm, ok := r.metaCache.Get(sref, digest); ok {
+				tr, err = r.transportFor(nref, h)
+				if err != nil {
+					rErr = errors.Wrapf(rErr, "host %q: failed to build transport for %q: %v",
+						h.Host, nref.String(), err)
+					continue
+				}
+				r.trPoolMu.Lock()
+				r.trPool[nref.Name()] = tr
+				r.trPoolMu.Unlock()
+				url = cm.URL
+				size = cm.Size
+				meta = blobMeta{etag: cm.ETag, lastModified: cm.LastModified}
+				mirror = h
+				rErr = nil
+				break
+			}
+		}
+
 		// Resolve redirection and get blob URL
-		url, err = r.resolveReference(nref, digest)
+		var rMeta blobMeta
+		url, rMeta, err = r.resolveReference(nref, digest, h)
 		if err != nil {
 			rErr = errors.Wrapf(rErr, "host %q: failed to resolve ref %q (%q): %v",
 				h.Host, nref.String(), digest, err)
@@ -191,13 +269,25 @@ func (r *Resolver) resolve(ref, digest string) (*fetcher, int64, error) {
 		}
 
 		// Get size information
-		size, err = getSize(url, tr)
+		var sMeta blobMeta
+		size, sMeta, err = getSize(url, tr)
 		if err != nil {
 			rErr = errors.Wrapf(rErr, "host %q: failed to get size of %q: %v",
 				h.Host, url, err)
 			continue // try another host
 		}
 
+		meta = sMeta.merge(rMeta)
+		if r.metaCache != nil {
+			r.metaCache.Add(sref, digest, cache.BlobMetadata{
+				URL:          url,
+				Size:         size,
+				ETag:         meta.etag,
+				LastModified: meta.lastModified,
+			})
+		}
+
+		mirror = h
 		rErr = nil // Hit one accessible mirror
 		break
 	}
@@ -206,16 +296,21 @@ func (r *Resolver) resolve(ref, digest string) (*fetcher, int64, error) {
 	}
 
 	return &fetcher{
-		resolver: r,
-		ref:      ref,
-		digest:   digest,
-		nref:     nref,
-		url:      url,
-		tr:       tr,
+		resolver:      r,
+		ref:           ref,
+		digest:        digest,
+		nref:          nref,
+		url:           url,
+		tr:            tr,
+		pull:          mirror.Pull,
+		multiRange:    probeMultiRange(url, tr),
+		etag:          meta.etag,
+		lastModified:  meta.lastModified,
+		contentDigest: meta.digest,
 	}, size, nil
 }
 
-func (r *Resolver) resolveReference(ref name.Reference, digest string) (string, error) {
+func (r *Resolver) resolveReference(ref name.Reference, digest string, h MirrorConfig) (string, blobMeta, error) {
 	r.trPoolMu.Lock()
 	defer r.trPoolMu.Unlock()
 
@@ -228,42 +323,42 @@ func (r *Resolver) resolveReference(ref name.Reference, digest string) (string,
 
 	// Try to use cached transport (cahced per reference name)
 	if tr, ok := r.trPool[ref.Name()]; ok {
-		if url, err := redirect(endpointURL, tr); err == nil {
-			return url, nil
+		if url, meta, err := redirect(endpointURL, tr); err == nil {
+			return url, meta, nil
 		}
 	}
 
 	// transport is unavailable/expired so refresh the transport and try again
-	tr, err := authnTransport(ref, r.transport, r.keychain)
+	tr, err := r.transportFor(ref, h)
 	if err != nil {
-		return "", err
+		return "", blobMeta{}, err
 	}
-	url, err := redirect(endpointURL, tr)
+	url, meta, err := redirect(endpointURL, tr)
 	if err != nil {
-		return "", err
+		return "", blobMeta{}, err
 	}
 
 	// Update transports cache
 	r.trPool[ref.Name()] = tr
 
-	return url, nil
+	return url, meta, nil
 }
 
-func redirect(endpointURL string, tr http.RoundTripper) (url string, err error) {
+func redirect(endpointURL string, tr http.RoundTripper) (url string, meta blobMeta, err error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 
 	// We use GET request for GCR.
 	req, err := http.NewRequest("GET", endpointURL, nil)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to request to the registry of %q", endpointURL)
+		return "", blobMeta{}, errors.Wrapf(err, "failed to request to the registry of %q", endpointURL)
 	}
 	req = req.WithContext(ctx)
 	req.Close = false
 	req.Header.Set("Range", "bytes=0-1")
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		return "", errors.Wrapf(err, "failed to request to %q", endpointURL)
+		return "", blobMeta{}, errors.Wrapf(err, "failed to request to %q", endpointURL)
 	}
 	defer func() {
 		io.Copy(ioutil.Discard, res.Body)
@@ -276,31 +371,121 @@ func redirect(endpointURL string, tr http.RoundTripper) (url string, err error)
 		// TODO: Support nested redirection
 		url = redir
 	} else {
-		return "", fmt.Errorf("failed to access to %q with code %v",
+		return "", blobMeta{}, fmt.Errorf("failed to access to %q with code %v",
 			endpointURL, res.StatusCode)
 	}
 
-	return
+	return url, metaFromHeader(res.Header), nil
 }
 
-func getSize(url string, tr http.RoundTripper) (int64, error) {
+func getSize(url string, tr http.RoundTripper) (int64, blobMeta, error) {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	req, err := http.NewRequest("HEAD", url, nil)
 	if err != nil {
-		return 0, err
+		return 0, blobMeta{}, err
 	}
 	req = req.WithContext(ctx)
 	req.Close = false
 	res, err := tr.RoundTrip(req)
 	if err != nil {
-		return 0, err
+		return 0, blobMeta{}, err
 	}
 	defer res.Body.Close()
 	if res.StatusCode != http.StatusOK {
-		return 0, fmt.Errorf("failed HEAD request with code %v", res.StatusCode)
+		return 0, blobMeta{}, fmt.Errorf("failed HEAD request with code %v", res.StatusCode)
 	}
-	return strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+	if err != nil {
+		return 0, blobMeta{}, err
+	}
+	return size, metaFromHeader(res.Header), nil
+}
+
+// blobMeta holds the cache-validator headers a registry returned for a blob,
+// letting fetcher.check revalidate with a conditional request instead of
+// re-fetching bytes just to confirm nothing changed.
+type blobMeta struct {
+	etag         string
+	lastModified string
+	digest       string // Docker-Content-Digest
+}
+
+// merge fills in m's empty fields from o, preferring m's own values where set.
+func (m blobMeta) merge(o blobMeta) blobMeta {
+	if m.etag == "" {
+		m.etag = o.etag
+	}
+	if m.lastModified == "" {
+		m.lastModified = o.lastModified
+	}
+	if m.digest == "" {
+		m.digest = o.digest
+	}
+	return m
+}
+
+func metaFromHeader(h http.Header) blobMeta {
+	return blobMeta{
+		etag:         h.Get("ETag"),
+		lastModified: h.Get("Last-Modified"),
+		digest:       h.Get("Docker-Content-Digest"),
+	}
+}
+
+// mirrorRepoPath prepends h's PathPrefix (trimmed of leading/trailing
+// slashes) to repoPath, for mirrors that serve the upstream repository under
+// a fixed sub-path. repoPath is returned unchanged when PathPrefix is unset.
+func mirrorRepoPath(repoPath string, h MirrorConfig) string {
+	if h.PathPrefix == "" {
+		return repoPath
+	}
+	return strings.Trim(h.PathPrefix, "/") + "/" + repoPath
+}
+
+// transportFor builds the RoundTripper chain to use for mirror h. A mirror
+// with a static Token entirely skips the keychain/token-exchange dance;
+// otherwise the usual authenticated transport is built and, in both cases,
+// any configured extra headers are injected on top.
+func (r *Resolver) transportFor(ref name.Reference, h MirrorConfig) (http.RoundTripper, error) {
+	var tr http.RoundTripper
+	if h.Token != "" {
+		tr = r.transport
+	} else {
+		authed, err := authnTransport(ref, r.transport, r.keychain)
+		if err != nil {
+			return nil, err
+		}
+		tr = authed
+	}
+	if h.Token == "" && len(h.Header) == 0 {
+		return tr, nil
+	}
+	headers := make(map[string][]string, len(h.Header)+1)
+	for k, v := range h.Header {
+		headers[k] = v
+	}
+	if h.Token != "" {
+		headers["Authorization"] = []string{"Bearer " + h.Token}
+	}
+	return &headerRoundTripper{base: tr, headers: headers}, nil
+}
+
+// headerRoundTripper injects a fixed set of headers into every request
+// before delegating to base.
+type headerRoundTripper struct {
+	base    http.RoundTripper
+	headers map[string][]string
+}
+
+func (h *headerRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	creq := req.Clone(req.Context())
+	for k, vs := range h.headers {
+		for _, v := range vs {
+			creq.Header.Add(k, v)
+		}
+	}
+	return h.base.RoundTrip(creq)
 }
 
 func authnTransport(ref name.Reference, tr http.RoundTripper, keychain authn.Keychain) (http.RoundTripper, error) {
@@ -330,6 +515,11 @@ func authnTransport(ref name.Reference, tr http.RoundTripper, keychain authn.Key
 	return rTr, err
 }
 
+// maxSingleRangeWorkers bounds the worker pool used to fan out the
+// single-range fallback GETs so that a layer with many small chunks doesn't
+// open an unbounded number of connections to the registry.
+const maxSingleRangeWorkers = 10
+
 type fetcher struct {
 	resolver *Resolver
 	ref      string
@@ -337,15 +527,38 @@ type fetcher struct {
 	nref     name.Reference
 	url      string
 	tr       http.RoundTripper
+
+	// pull records whether the mirror this fetcher resolved against was
+	// declared pull-through only (MirrorConfig.Pull).
+	pull bool
+
+	// multiRange records whether this mirror was observed to honor a
+	// comma-separated Range header with a true multipart response. It is
+	// probed once in Resolver.resolve and may additionally be flipped to
+	// false at runtime if a multipart request unexpectedly comes back
+	// single-part, so later calls skip straight to the fallback path.
+	multiRangeMu sync.Mutex
+	multiRange   bool
+
+	// metaMu guards the cache-validator headers below, which check() sends
+	// back on later calls to revalidate cheaply and may refresh on a 200
+	// response (a 304 leaves them untouched).
+	metaMu        sync.Mutex
+	etag          string
+	lastModified  string
+	contentDigest string
 }
 
+// refresh re-resolves this fetcher's blob, bypassing any cached metadata so
+// that a changed or expired URL (the reason Refresh was called in the first
+// place) is actually observed instead of being masked by a stale metaCache
+// hit.
 func (f *fetcher) refresh() (*fetcher, int64, error) {
-	return f.resolver.resolve(f.ref, f.digest)
+	return f.resolver.resolve(f.ref, f.digest, true)
 }
 
 func (f *fetcher) fetch(requests []region, opts ...Option) (map[region][]byte, error) {
 	var (
-		remoteData  = map[region][]byte{}
 		opt         = options{}
 		tr          = f.tr
 		ctx, cancel = context.WithTimeout(context.Background(), 30*time.Second)
@@ -360,6 +573,15 @@ func (f *fetcher) fetch(requests []region, opts ...Option) (map[region][]byte, e
 	if opt.tr != nil {
 		tr = opt.tr
 	}
+
+	f.multiRangeMu.Lock()
+	multiRange := f.multiRange
+	f.multiRangeMu.Unlock()
+	if !multiRange {
+		return f.fetchSingle(ctx, tr, requests)
+	}
+
+	remoteData := map[region][]byte{}
 	req, err := http.NewRequest("GET", f.url, nil)
 	if err != nil {
 		return nil, err
@@ -382,15 +604,22 @@ func (f *fetcher) fetch(requests []region, opts ...Option) (map[region][]byte, e
 	}
 
 	if res.StatusCode == http.StatusOK {
-		// We are getting the whole blob in one part (= status 200)
+		// We asked for ranges but got the whole blob back in one part. Some
+		// registries (and mirrors in front of them) ignore multi-range
+		// headers entirely; remember that and fall back for this and future
+		// calls instead of paying for the whole blob every time.
+		size, lerr := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
+		if lerr == nil {
+			if isFullBlobResponse(requests, size) {
+				io.Copy(ioutil.Discard, res.Body)
+				f.disableMultiRange()
+				return f.fetchSingle(ctx, tr, requests)
+			}
+		}
 		data, err := ioutil.ReadAll(res.Body) // TODO: chunk data for saving memory
 		if err != nil {
 			return nil, errors.Wrapf(err, "Failed to read response body from %q", f.url)
 		}
-		size, err := strconv.ParseInt(res.Header.Get("Content-Length"), 10, 64)
-		if err != nil {
-			return nil, errors.Wrapf(err, "failed to parse Content-Length for %q", f.url)
-		}
 		if int64(len(data)) != size {
 			return nil, errors.Wrapf(err, "broken response body:got size %d; want %d for %q",
 				len(data), size, f.url)
@@ -402,7 +631,12 @@ func (f *fetcher) fetch(requests []region, opts ...Option) (map[region][]byte, e
 	// We are getting a set of chunk as a multipart body.
 	mediaType, params, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
 	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
-		return nil, errors.Wrapf(err, "invalid media type %q for %q", mediaType, f.url)
+		// The registry responded 206 but didn't actually multipart-encode
+		// the ranges we asked for (single-range-only servers do this).
+		// Fall back to single-range requests from here on.
+		io.Copy(ioutil.Discard, res.Body)
+		f.disableMultiRange()
+		return f.fetchSingle(ctx, tr, requests)
 	}
 	mr := multipart.NewReader(res.Body, params["boundary"])
 	mr.NextPart() // Drop the dummy range.
@@ -432,6 +666,175 @@ func (f *fetcher) fetch(requests []region, opts ...Option) (map[region][]byte, e
 	return remoteData, nil
 }
 
+// disableMultiRange permanently flips this fetcher to the single-range
+// fallback path. It's called once a multi-range response turns out not to
+// be what we asked for, so we stop paying for a failed multipart parse (or
+// a whole-blob download) on every subsequent fetch.
+func (f *fetcher) disableMultiRange() {
+	f.multiRangeMu.Lock()
+	f.multiRange = false
+	f.multiRangeMu.Unlock()
+}
+
+// isFullBlobResponse reports whether a 200 response of the given size looks
+// like the registry served the entire blob instead of honoring our range
+// request, which only makes sense when we actually asked for something
+// smaller than the whole thing.
+func isFullBlobResponse(requests []region, size int64) bool {
+	for _, reg := range requests {
+		if reg.e+1 >= size {
+			continue
+		}
+		return true
+	}
+	return false
+}
+
+// fetchSingle fetches requests as a bounded pool of parallel single-range
+// GETs, coalescing adjacent/overlapping regions first to minimize the
+// number of round trips against registries that don't support multi-range
+// GET.
+func (f *fetcher) fetchSingle(ctx context.Context, tr http.RoundTripper, requests []region) (map[region][]byte, error) {
+	coalesced := coalesce(requests)
+
+	var (
+		wg      sync.WaitGroup
+		sem     = make(chan struct{}, maxSingleRangeWorkers)
+		dataMu  sync.Mutex
+		data    = make(map[region][]byte, len(coalesced))
+		errOnce sync.Once
+		ferr    error
+	)
+	for _, creg := range coalesced {
+		creg := creg
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			d, err := f.fetchRange(ctx, tr, creg)
+			if err != nil {
+				errOnce.Do(func() { ferr = err })
+				return
+			}
+			dataMu.Lock()
+			data[creg] = d
+			dataMu.Unlock()
+		}()
+	}
+	wg.Wait()
+	if ferr != nil {
+		return nil, ferr
+	}
+
+	// Split the coalesced regions' bytes back into the originally
+	// requested sub-regions.
+	remoteData := make(map[region][]byte, len(requests))
+	for _, reg := range requests {
+		for creg, d := range data {
+			if reg.b >= creg.b && reg.e <= creg.e {
+				remoteData[reg] = d[reg.b-creg.b : reg.e-creg.b+1]
+				break
+			}
+		}
+		if _, ok := remoteData[reg]; !ok {
+			return nil, fmt.Errorf("failed to locate fetched data for region %v", reg)
+		}
+	}
+	return remoteData, nil
+}
+
+// fetchRange issues a single-range GET for reg and returns its body.
+func (f *fetcher) fetchRange(ctx context.Context, tr http.RoundTripper, reg region) ([]byte, error) {
+	req, err := http.NewRequest("GET", f.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req = req.WithContext(ctx)
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", reg.b, reg.e))
+	req.Header.Add("Accept-Encoding", "identity")
+	req.Close = false
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to request range %v to %q", reg, f.url)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
+		return nil, fmt.Errorf("unexpected status code on range %v of %q: %v", reg, f.url, res.Status)
+	}
+	data, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read range %v body from %q", reg, f.url)
+	}
+	if int64(len(data)) != reg.size() {
+		return nil, fmt.Errorf("broken range response: got size %d; want %d for range %v of %q",
+			len(data), reg.size(), reg, f.url)
+	}
+	return data, nil
+}
+
+// coalesce merges adjacent and overlapping regions so the single-range
+// fallback issues as few requests as possible.
+func coalesce(requests []region) []region {
+	if len(requests) == 0 {
+		return nil
+	}
+	sorted := make([]region, len(requests))
+	copy(sorted, requests)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].b < sorted[j].b })
+	merged := []region{sorted[0]}
+	for _, reg := range sorted[1:] {
+		last := &merged[len(merged)-1]
+		if reg.b <= last.e+1 {
+			if reg.e > last.e {
+				last.e = reg.e
+			}
+			continue
+		}
+		merged = append(merged, reg)
+	}
+	return merged
+}
+
+// probeMultiRange issues a small multi-range request to determine whether
+// this mirror honors a comma-separated Range header with a genuine
+// multipart/byteranges response, so the resolver can pick the right
+// fetch strategy up front instead of discovering it on the first real
+// fetch.
+func probeMultiRange(url string, tr http.RoundTripper) bool {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return false
+	}
+	req = req.WithContext(ctx)
+	req.Close = false
+	req.Header.Set("Range", "bytes=0-0,2-2")
+	req.Header.Add("Accept-Encoding", "identity")
+	res, err := tr.RoundTrip(req)
+	if err != nil {
+		return false
+	}
+	defer func() {
+		io.Copy(ioutil.Discard, res.Body)
+		res.Body.Close()
+	}()
+	if res.StatusCode != http.StatusPartialContent {
+		return false
+	}
+	mediaType, _, err := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	return err == nil && strings.HasPrefix(mediaType, "multipart/")
+}
+
+// check revalidates that f's blob is still the one we resolved. If we hold
+// cache validators from a previous resolve or check, it sends them as
+// If-None-Match/If-Modified-Since; a 304 confirms the blob is unchanged
+// without transferring any of its bytes, which is the common case on a
+// warm check. Otherwise it falls back to the original small-range GET; if
+// the registry then returns an ETag or Last-Modified that differs from the
+// one held, the blob has changed and check returns an error. Otherwise it
+// records whatever validators the registry returns for next time.
 func (f *fetcher) check() error {
 	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
@@ -442,6 +845,17 @@ func (f *fetcher) check() error {
 	req = req.WithContext(ctx)
 	req.Close = false
 	req.Header.Set("Range", "bytes=0-1")
+
+	f.metaMu.Lock()
+	etag, lastModified := f.etag, f.lastModified
+	f.metaMu.Unlock()
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		req.Header.Set("If-Modified-Since", lastModified)
+	}
+
 	res, err := f.tr.RoundTrip(req)
 	if err != nil {
 		return errors.Wrapf(err, "check failed: failed to request to registry %q", f.url)
@@ -450,13 +864,41 @@ func (f *fetcher) check() error {
 		io.Copy(ioutil.Discard, res.Body)
 		res.Body.Close()
 	}()
+	if res.StatusCode == http.StatusNotModified {
+		return nil
+	}
 	if res.StatusCode != http.StatusOK && res.StatusCode != http.StatusPartialContent {
 		return fmt.Errorf("unexpected status code %v for %q", res.StatusCode, f.url)
 	}
+	m := metaFromHeader(res.Header)
+	if etag != "" && m.etag != "" && m.etag != etag {
+		return fmt.Errorf("blob %q changed: ETag %q; want %q", f.url, m.etag, etag)
+	}
+	if lastModified != "" && m.lastModified != "" && m.lastModified != lastModified {
+		return fmt.Errorf("blob %q changed: Last-Modified %q; want %q", f.url, m.lastModified, lastModified)
+	}
+	f.updateMeta(m)
 
 	return nil
 }
 
+// updateMeta refreshes f's cache validators from a freshly observed
+// response, keeping any previous non-empty value the new response didn't
+// repeat.
+func (f *fetcher) updateMeta(m blobMeta) {
+	f.metaMu.Lock()
+	defer f.metaMu.Unlock()
+	if m.etag != "" {
+		f.etag = m.etag
+	}
+	if m.lastModified != "" {
+		f.lastModified = m.lastModified
+	}
+	if m.digest != "" {
+		f.contentDigest = m.digest
+	}
+}
+
 func (f *fetcher) authn(tr http.RoundTripper, keychain authn.Keychain) (http.RoundTripper, error) {
 	return authnTransport(f.nref, tr, keychain)
 }
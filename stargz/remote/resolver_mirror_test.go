@@ -0,0 +1,115 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/google/go-containerregistry/pkg/name"
+)
+
+func TestMirrorRepoPath(t *testing.T) {
+	tests := []struct {
+		name   string
+		repo   string
+		prefix string
+		want   string
+	}{
+		{name: "no prefix", repo: "library/busybox", prefix: "", want: "library/busybox"},
+		{name: "prefix without slashes", repo: "library/busybox", prefix: "v2", want: "v2/library/busybox"},
+		{name: "prefix with leading and trailing slashes", repo: "library/busybox", prefix: "/v2/", want: "v2/library/busybox"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := mirrorRepoPath(tt.repo, MirrorConfig{PathPrefix: tt.prefix})
+			if got != tt.want {
+				t.Errorf("mirrorRepoPath(%q, prefix=%q) = %q; want %q", tt.repo, tt.prefix, got, tt.want)
+			}
+		})
+	}
+}
+
+// recordingRoundTripper records the last request it saw and returns a fixed
+// response, without making any network call.
+type recordingRoundTripper struct {
+	req *http.Request
+}
+
+func (rt *recordingRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rt.req = req
+	return &http.Response{StatusCode: http.StatusOK, Body: http.NoBody}, nil
+}
+
+func TestTransportForStaticToken(t *testing.T) {
+	base := &recordingRoundTripper{}
+	r := &Resolver{transport: base}
+	h := MirrorConfig{
+		Host:   "mirror.example.com",
+		Token:  "s3cr3t",
+		Header: map[string][]string{"X-Custom": {"yes"}},
+	}
+	ref, err := name.ParseReference("mirror.example.com/library/busybox")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	tr, err := r.transportFor(ref, h)
+	if err != nil {
+		t.Fatalf("transportFor failed: %v", err)
+	}
+
+	req, err := http.NewRequest("GET", "https://mirror.example.com/v2/library/busybox/blobs/sha256:deadbeef", nil)
+	if err != nil {
+		t.Fatalf("failed to build request: %v", err)
+	}
+	if _, err := tr.RoundTrip(req); err != nil {
+		t.Fatalf("RoundTrip failed: %v", err)
+	}
+
+	if got := base.req.Header.Get("Authorization"); got != "Bearer s3cr3t" {
+		t.Errorf("Authorization header = %q; want %q", got, "Bearer s3cr3t")
+	}
+	if got := base.req.Header.Get("X-Custom"); got != "yes" {
+		t.Errorf("X-Custom header = %q; want %q", got, "yes")
+	}
+	// The original request passed to RoundTrip must be untouched: headerRoundTripper
+	// must inject headers into a clone, not mutate the caller's request.
+	if req.Header.Get("Authorization") != "" {
+		t.Errorf("original request was mutated; Authorization = %q", req.Header.Get("Authorization"))
+	}
+}
+
+func TestTransportForStaticTokenAlwaysWraps(t *testing.T) {
+	// A static Token always needs an Authorization header injected, even
+	// when the mirror configures no extra Header entries of its own.
+	base := &recordingRoundTripper{}
+	r := &Resolver{transport: base}
+	h := MirrorConfig{Host: "mirror.example.com", Token: "s3cr3t"}
+	ref, err := name.ParseReference("mirror.example.com/library/busybox")
+	if err != nil {
+		t.Fatalf("failed to parse reference: %v", err)
+	}
+
+	tr, err := r.transportFor(ref, h)
+	if err != nil {
+		t.Fatalf("transportFor failed: %v", err)
+	}
+	if _, ok := tr.(*headerRoundTripper); !ok {
+		t.Errorf("expected a *headerRoundTripper when Token is set, got %T", tr)
+	}
+}
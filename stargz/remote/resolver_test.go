@@ -0,0 +1,191 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package remote
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestCoalesce(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []region
+		want []region
+	}{
+		{
+			name: "empty",
+			in:   nil,
+			want: nil,
+		},
+		{
+			name: "single",
+			in:   []region{{b: 10, e: 20}},
+			want: []region{{b: 10, e: 20}},
+		},
+		{
+			name: "adjacent regions merge",
+			in:   []region{{b: 0, e: 9}, {b: 10, e: 19}},
+			want: []region{{b: 0, e: 19}},
+		},
+		{
+			name: "overlapping regions merge",
+			in:   []region{{b: 0, e: 15}, {b: 10, e: 19}},
+			want: []region{{b: 0, e: 19}},
+		},
+		{
+			name: "disjoint regions stay separate",
+			in:   []region{{b: 0, e: 9}, {b: 20, e: 29}},
+			want: []region{{b: 0, e: 9}, {b: 20, e: 29}},
+		},
+		{
+			name: "unsorted input is sorted before merging",
+			in:   []region{{b: 20, e: 29}, {b: 0, e: 9}, {b: 10, e: 19}},
+			want: []region{{b: 0, e: 29}},
+		},
+		{
+			name: "contained region is absorbed",
+			in:   []region{{b: 0, e: 29}, {b: 10, e: 19}},
+			want: []region{{b: 0, e: 29}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := coalesce(tt.in)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("coalesce(%v) = %v; want %v", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIsFullBlobResponse(t *testing.T) {
+	tests := []struct {
+		name     string
+		requests []region
+		size     int64
+		want     bool
+	}{
+		{
+			name:     "request for the whole blob is not a mismatch",
+			requests: []region{{b: 0, e: 99}},
+			size:     100,
+			want:     false,
+		},
+		{
+			name:     "request smaller than the blob got the whole thing back",
+			requests: []region{{b: 0, e: 9}},
+			size:     100,
+			want:     true,
+		},
+		{
+			name:     "one of several requested regions is smaller than the blob",
+			requests: []region{{b: 0, e: 99}, {b: 0, e: 9}},
+			size:     100,
+			want:     true,
+		},
+		{
+			name:     "no requests",
+			requests: nil,
+			size:     100,
+			want:     false,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isFullBlobResponse(tt.requests, tt.size); got != tt.want {
+				t.Errorf("isFullBlobResponse(%v, %d) = %v; want %v", tt.requests, tt.size, got, tt.want)
+			}
+		})
+	}
+}
+
+// brokenMultiRangeRoundTripper simulates a registry (or a mirror in front of
+// one) that ignores a multi-range Range header entirely and serves the
+// whole blob back with a 200, the case fetch's isFullBlobResponse check
+// exists to detect. It answers later single-range requests correctly.
+type brokenMultiRangeRoundTripper struct {
+	full            []byte
+	singleRangeHits int
+}
+
+func (rt *brokenMultiRangeRoundTripper) RoundTrip(req *http.Request) (*http.Response, error) {
+	rangeHeader := req.Header.Get("Range")
+	if strings.Contains(rangeHeader, ",") {
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Length": []string{strconv.Itoa(len(rt.full))}},
+			Body:       ioutil.NopCloser(bytes.NewReader(rt.full)),
+		}, nil
+	}
+	rt.singleRangeHits++
+	var b, e int64
+	if _, err := fmt.Sscanf(rangeHeader, "bytes=%d-%d", &b, &e); err != nil {
+		return nil, fmt.Errorf("failed to parse Range header %q: %v", rangeHeader, err)
+	}
+	data := rt.full[b : e+1]
+	return &http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header:     http.Header{"Content-Range": []string{fmt.Sprintf("bytes %d-%d/%d", b, e, len(rt.full))}},
+		Body:       ioutil.NopCloser(bytes.NewReader(data)),
+	}, nil
+}
+
+// TestFetchFallsBackOnSuspiciousFullBlobResponse is a regression test for the
+// inverted isFullBlobResponse check: requesting two small sub-ranges of a
+// much larger blob from a registry that ignores Range and returns the whole
+// thing must disable multi-range and retry as single-range requests,
+// returning exactly the requested sub-ranges rather than the mis-served
+// full body.
+func TestFetchFallsBackOnSuspiciousFullBlobResponse(t *testing.T) {
+	full := bytes.Repeat([]byte{0xAB}, 1<<20)
+	copy(full[100:110], []byte("0123456789"))
+	copy(full[50000:50010], []byte("abcdefghij"))
+	rt := &brokenMultiRangeRoundTripper{full: full}
+	f := &fetcher{url: "http://example.com/blob", tr: rt, multiRange: true}
+
+	requests := []region{{b: 100, e: 109}, {b: 50000, e: 50009}}
+	got, err := f.fetch(requests)
+	if err != nil {
+		t.Fatalf("fetch failed: %v", err)
+	}
+
+	if rt.singleRangeHits == 0 {
+		t.Fatal("fetch did not fall back to single-range requests for a suspicious full-blob response")
+	}
+	f.multiRangeMu.Lock()
+	stillMultiRange := f.multiRange
+	f.multiRangeMu.Unlock()
+	if stillMultiRange {
+		t.Error("fetch did not disable multi-range after a suspicious full-blob response")
+	}
+	for _, reg := range requests {
+		data, ok := got[reg]
+		if !ok {
+			t.Fatalf("missing data for requested region %v", reg)
+		}
+		if !bytes.Equal(data, full[reg.b:reg.e+1]) {
+			t.Errorf("region %v: got %q; want %q", reg, data, full[reg.b:reg.e+1])
+		}
+	}
+}
@@ -0,0 +1,242 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+// Package zstdchunked parses the zstd:chunked layer format: a tar archive
+// whose file contents are stored as independently decodable zstd frames,
+// with a trailing JSON manifest describing where each frame lives. This
+// lets a reader fetch and decompress a single file (or a single chunk of a
+// large file) without touching the rest of the blob, the same property
+// eStargz provides for gzip-based layers.
+package zstdchunked
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"github.com/klauspost/compress/zstd"
+	digest "github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+)
+
+// footerSize is the size of the trailing footer: an 8-byte little-endian
+// offset, from the start of the blob, of the (zstd-compressed) manifest.
+const footerSize = 8
+
+// TOCEntry describes one chunk of one file as recorded in the manifest:
+// its location in the compressed blob (Offset/Length, a single zstd frame)
+// and its location within the file's uncompressed content (ChunkOffset/
+// UncompressedSize).
+type TOCEntry struct {
+	Path             string `json:"path"`
+	Offset           int64  `json:"offset"`
+	Length           int64  `json:"length"`
+	ChunkOffset      int64  `json:"chunkOffset"`
+	UncompressedSize int64  `json:"uncompressedSize"`
+	Digest           string `json:"digest"`
+}
+
+// Reader parses a zstd:chunked blob's trailing manifest and serves random
+// access to its files.
+type Reader struct {
+	sr             *io.SectionReader
+	entries        map[string][]*TOCEntry // path -> chunks, in ChunkOffset order
+	paths          []string               // manifest order, for stable iteration
+	manifestDigest digest.Digest
+}
+
+// ManifestDigest returns the digest of the (compressed, as stored in the
+// blob) manifest sr was parsed from. Open does not take a trusted digest
+// itself since the caller may not have one yet at parse time (e.g. when
+// probing a blob's format); callers that do have one, such as
+// reader.openIndex, must check it against ManifestDigest() before trusting
+// the parsed Reader, the same way estargz.Reader.TOCDigest() is checked.
+func (r *Reader) ManifestDigest() digest.Digest {
+	return r.manifestDigest
+}
+
+// Open reads and parses the manifest trailing sr. Before Open returns, every
+// manifest entry's frame location (Offset/Length) is checked to lie within
+// the frame data preceding the manifest, and its uncompressed range
+// (ChunkOffset/UncompressedSize) is checked to be non-negative, so a
+// malformed or hostile manifest is rejected here rather than causing a
+// panic or an out-of-range read later.
+func Open(sr *io.SectionReader) (*Reader, error) {
+	if sr.Size() < footerSize {
+		return nil, fmt.Errorf("blob too small to contain a zstd:chunked footer")
+	}
+	footer := make([]byte, footerSize)
+	if _, err := sr.ReadAt(footer, sr.Size()-footerSize); err != nil {
+		return nil, errors.Wrap(err, "failed to read zstd:chunked footer")
+	}
+	manifestOffset := int64(binary.LittleEndian.Uint64(footer))
+	if manifestOffset < 0 || manifestOffset > sr.Size()-footerSize {
+		return nil, fmt.Errorf("invalid zstd:chunked manifest offset %d", manifestOffset)
+	}
+	compressed := make([]byte, sr.Size()-footerSize-manifestOffset)
+	if _, err := sr.ReadAt(compressed, manifestOffset); err != nil {
+		return nil, errors.Wrap(err, "failed to read zstd:chunked manifest")
+	}
+	raw, err := decodeZstd(compressed)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to decompress zstd:chunked manifest")
+	}
+	var list []*TOCEntry
+	if err := json.Unmarshal(raw, &list); err != nil {
+		return nil, errors.Wrap(err, "failed to parse zstd:chunked manifest")
+	}
+	for _, e := range list {
+		if err := validateEntry(e, manifestOffset); err != nil {
+			return nil, errors.Wrapf(err, "invalid zstd:chunked manifest entry %q", e.Path)
+		}
+	}
+
+	entries := make(map[string][]*TOCEntry)
+	var paths []string
+	for _, e := range list {
+		if _, ok := entries[e.Path]; !ok {
+			paths = append(paths, e.Path)
+		}
+		entries[e.Path] = append(entries[e.Path], e)
+	}
+	for _, chunks := range entries {
+		sort.Slice(chunks, func(i, j int) bool { return chunks[i].ChunkOffset < chunks[j].ChunkOffset })
+	}
+
+	return &Reader{
+		sr:             sr,
+		entries:        entries,
+		paths:          paths,
+		manifestDigest: digest.FromBytes(compressed),
+	}, nil
+}
+
+// validateEntry rejects a manifest entry whose fields could cause an
+// out-of-range read or an invalid allocation size downstream: the frame it
+// points to (Offset/Length) must be a non-negative range that lies entirely
+// within the frame data preceding the manifest (i.e. before manifestOffset),
+// and its uncompressed range (ChunkOffset/UncompressedSize) must be
+// non-negative.
+func validateEntry(e *TOCEntry, manifestOffset int64) error {
+	if e.Offset < 0 || e.Length < 0 {
+		return fmt.Errorf("negative frame offset/length (%d/%d)", e.Offset, e.Length)
+	}
+	if e.Offset > manifestOffset || e.Length > manifestOffset-e.Offset {
+		return fmt.Errorf("frame [%d, %d) out of range of manifest offset %d", e.Offset, e.Offset+e.Length, manifestOffset)
+	}
+	if e.ChunkOffset < 0 || e.UncompressedSize < 0 {
+		return fmt.Errorf("negative chunk offset/size (%d/%d)", e.ChunkOffset, e.UncompressedSize)
+	}
+	return nil
+}
+
+// Paths returns every file path recorded in the manifest, in manifest order.
+func (r *Reader) Paths() []string {
+	return r.paths
+}
+
+// Lookup returns the lowest-offset chunk recorded for name.
+func (r *Reader) Lookup(name string) (*TOCEntry, bool) {
+	chunks, ok := r.entries[name]
+	if !ok || len(chunks) == 0 {
+		return nil, false
+	}
+	return chunks[0], true
+}
+
+// ChunkEntryForOffset returns the manifest entry whose uncompressed range
+// covers the given within-file offset.
+func (r *Reader) ChunkEntryForOffset(name string, offset int64) (*TOCEntry, bool) {
+	for _, c := range r.entries[name] {
+		if offset >= c.ChunkOffset && offset < c.ChunkOffset+c.UncompressedSize {
+			return c, true
+		}
+	}
+	return nil, false
+}
+
+// OpenFile returns an io.ReaderAt over the uncompressed content of name,
+// decompressing the covering zstd frame(s) on demand.
+func (r *Reader) OpenFile(name string) (io.ReaderAt, error) {
+	if _, ok := r.entries[name]; !ok {
+		return nil, fmt.Errorf("file %q not found", name)
+	}
+	return &file{r: r, name: name}, nil
+}
+
+type file struct {
+	r    *Reader
+	name string
+}
+
+// ReadAt decompresses and returns the uncompressed bytes of f starting at
+// off. Each frame is still decompressed independently, but if a read spans
+// several chunks whose compressed frames sit back-to-back in the blob, their
+// raw bytes are fetched with a single underlying read instead of one per
+// chunk, so a caller requesting a wide span doesn't pay one round trip per
+// chunk it covers.
+func (f *file) ReadAt(p []byte, off int64) (int, error) {
+	var entries []*TOCEntry
+	for o := off; o < off+int64(len(p)); {
+		ce, ok := f.r.ChunkEntryForOffset(f.name, o)
+		if !ok {
+			break
+		}
+		entries = append(entries, ce)
+		o = ce.ChunkOffset + ce.UncompressedSize
+	}
+
+	nr := 0
+	for i := 0; i < len(entries); {
+		j := i + 1
+		for j < len(entries) && entries[j].Offset == entries[j-1].Offset+entries[j-1].Length {
+			j++
+		}
+		run := entries[i:j]
+		runOffset := run[0].Offset
+		runLength := run[len(run)-1].Offset + run[len(run)-1].Length - runOffset
+		raw := make([]byte, runLength)
+		if _, err := f.r.sr.ReadAt(raw, runOffset); err != nil {
+			return nr, errors.Wrap(err, "failed to read zstd frame")
+		}
+		for _, ce := range run {
+			frame := raw[ce.Offset-runOffset : ce.Offset-runOffset+ce.Length]
+			data, err := decodeZstd(frame)
+			if err != nil {
+				return nr, errors.Wrap(err, "failed to decompress zstd frame")
+			}
+			if int64(len(data)) != ce.UncompressedSize {
+				return nr, fmt.Errorf("unexpected decompressed size %d; want %d", len(data), ce.UncompressedSize)
+			}
+			start := off + int64(nr) - ce.ChunkOffset
+			n := copy(p[nr:], data[start:])
+			nr += n
+		}
+		i = j
+	}
+	return nr, nil
+}
+
+func decodeZstd(b []byte) ([]byte, error) {
+	dec, err := zstd.NewReader(nil)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to create zstd decoder")
+	}
+	defer dec.Close()
+	return dec.DecodeAll(b, nil)
+}
@@ -0,0 +1,227 @@
+/*
+   Copyright The containerd Authors.
+
+   Licensed under the Apache License, Version 2.0 (the "License");
+   you may not use this file except in compliance with the License.
+   You may obtain a copy of the License at
+
+       http://www.apache.org/licenses/LICENSE-2.0
+
+   Unless required by applicable law or agreed to in writing, software
+   distributed under the License is distributed on an "AS IS" BASIS,
+   WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+   See the License for the specific language governing permissions and
+   limitations under the License.
+*/
+
+package zstdchunked
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// buildBlob zstd-compresses content as a single frame, appends a manifest
+// (built from entries, with Offset/Length filled in for that one frame) and
+// the trailing footer, and returns the resulting blob bytes.
+func buildBlob(t *testing.T, path string, content []byte, entries []*TOCEntry) []byte {
+	t.Helper()
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+
+	frame := enc.EncodeAll(content, nil)
+
+	var buf bytes.Buffer
+	buf.Write(frame)
+
+	for _, e := range entries {
+		if e.Path == path {
+			e.Offset = 0
+			e.Length = int64(len(frame))
+		}
+	}
+	manifestOffset := int64(buf.Len())
+	manifest, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	buf.Write(enc.EncodeAll(manifest, nil))
+
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer, uint64(manifestOffset))
+	buf.Write(footer)
+
+	return buf.Bytes()
+}
+
+func TestOpenRoundTrip(t *testing.T) {
+	const path = "hello.txt"
+	content := []byte("hello zstd:chunked world")
+	entries := []*TOCEntry{{
+		Path:             path,
+		ChunkOffset:      0,
+		UncompressedSize: int64(len(content)),
+		Digest:           "sha256:deadbeef",
+	}}
+	blob := buildBlob(t, path, content, entries)
+
+	r, err := Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	if got := r.Paths(); len(got) != 1 || got[0] != path {
+		t.Fatalf("Paths() = %v; want [%q]", got, path)
+	}
+
+	ra, err := r.OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	got := make([]byte, len(content))
+	if _, err := ra.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Errorf("ReadAt = %q; want %q", got, content)
+	}
+
+	if r.ManifestDigest() == "" {
+		t.Errorf("ManifestDigest() returned empty digest")
+	}
+}
+
+// countingReaderAt wraps an io.ReaderAt and counts how many ReadAt calls it
+// receives, so tests can assert on the number of underlying raw reads
+// file.ReadAt issues.
+type countingReaderAt struct {
+	io.ReaderAt
+	calls int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	c.calls++
+	return c.ReaderAt.ReadAt(p, off)
+}
+
+func TestReadAtBatchesContiguousChunks(t *testing.T) {
+	const path = "big.txt"
+	chunks := [][]byte{[]byte("first-chunk."), []byte("second-chunk"), []byte("third-chunk.")}
+
+	enc, err := zstd.NewWriter(nil)
+	if err != nil {
+		t.Fatalf("failed to create zstd encoder: %v", err)
+	}
+	defer enc.Close()
+
+	var buf bytes.Buffer
+	var entries []*TOCEntry
+	var chunkOffset int64
+	for _, c := range chunks {
+		frame := enc.EncodeAll(c, nil)
+		entries = append(entries, &TOCEntry{
+			Path:             path,
+			Offset:           int64(buf.Len()),
+			Length:           int64(len(frame)),
+			ChunkOffset:      chunkOffset,
+			UncompressedSize: int64(len(c)),
+		})
+		buf.Write(frame)
+		chunkOffset += int64(len(c))
+	}
+	manifestOffset := int64(buf.Len())
+	manifest, err := json.Marshal(entries)
+	if err != nil {
+		t.Fatalf("failed to marshal manifest: %v", err)
+	}
+	buf.Write(enc.EncodeAll(manifest, nil))
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer, uint64(manifestOffset))
+	buf.Write(footer)
+	blob := buf.Bytes()
+
+	counting := &countingReaderAt{ReaderAt: bytes.NewReader(blob)}
+	r, err := Open(io.NewSectionReader(counting, 0, int64(len(blob))))
+	if err != nil {
+		t.Fatalf("Open failed: %v", err)
+	}
+
+	ra, err := r.OpenFile(path)
+	if err != nil {
+		t.Fatalf("OpenFile failed: %v", err)
+	}
+	counting.calls = 0 // ignore reads Open already issued
+
+	want := bytes.Join(chunks, nil)
+	got := make([]byte, len(want))
+	if _, err := ra.ReadAt(got, 0); err != nil && err != io.EOF {
+		t.Fatalf("ReadAt failed: %v", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Fatalf("ReadAt = %q; want %q", got, want)
+	}
+	if counting.calls != 1 {
+		t.Errorf("ReadAt spanning 3 contiguous chunks issued %d raw reads; want 1", counting.calls)
+	}
+}
+
+func TestOpenRejectsTooSmallBlob(t *testing.T) {
+	tiny := []byte{1, 2, 3}
+	_, err := Open(io.NewSectionReader(bytes.NewReader(tiny), 0, int64(len(tiny))))
+	if err == nil {
+		t.Fatal("expected an error for a blob too small to hold a footer")
+	}
+}
+
+func TestOpenRejectsOutOfRangeManifestOffset(t *testing.T) {
+	footer := make([]byte, footerSize)
+	binary.LittleEndian.PutUint64(footer, uint64(1<<32)) // way past the blob
+	blob := append([]byte("short"), footer...)
+
+	_, err := Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err == nil {
+		t.Fatal("expected an error for a manifest offset beyond the blob")
+	}
+}
+
+func TestOpenRejectsNegativeLength(t *testing.T) {
+	const path = "evil.txt"
+	entries := []*TOCEntry{{
+		Path:             path,
+		Offset:           0,
+		Length:           -1, // malicious/corrupted manifest
+		ChunkOffset:      0,
+		UncompressedSize: 4,
+	}}
+	blob := buildBlob(t, "", nil, entries) // don't fill in Offset/Length for "path"
+
+	_, err := Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err == nil {
+		t.Fatal("expected an error for a manifest entry with a negative length")
+	}
+}
+
+func TestOpenRejectsFrameBeyondManifest(t *testing.T) {
+	const path = "evil.txt"
+	entries := []*TOCEntry{{
+		Path:             path,
+		Offset:           1 << 20, // far past where the manifest actually starts
+		Length:           16,
+		ChunkOffset:      0,
+		UncompressedSize: 4,
+	}}
+	blob := buildBlob(t, "", nil, entries)
+
+	_, err := Open(io.NewSectionReader(bytes.NewReader(blob), 0, int64(len(blob))))
+	if err == nil {
+		t.Fatal("expected an error for a manifest entry pointing past the frame data region")
+	}
+}